@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/crypto/acme"
+)
+
+// renewRetryInterval is how long renewLoop waits before retrying
+// after a failed issuance attempt.
+const renewRetryInterval = 10 * time.Minute
+
+// acmeManager issues and renews a single wildcard certificate for
+// Host.ReverseProxySuffix via ACME DNS-01, completing the challenge with a
+// TXT record in the Link.HostedZoneID Route53 zone. Issued certs are
+// cached in S3 so restarts and multi-replica mirage-ecs deployments share
+// them instead of re-issuing on every boot.
+type acmeManager struct {
+	cfg    *Config
+	client *acme.Client
+	cache  *s3Cache
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newACMEManager(cfg *Config) (*acmeManager, error) {
+	a := cfg.Listen.TLS.ACME
+	if a == nil {
+		return nil, fmt.Errorf("listen.tls.acme is required for cert_source=%q", TLSCertSourceACME)
+	}
+	if cfg.Link.HostedZoneID == "" {
+		return nil, fmt.Errorf("link.hosted_zone_id is required to complete ACME dns-01 challenges")
+	}
+
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate acme account key: %w", err)
+	}
+
+	m := &acmeManager{
+		cfg:    cfg,
+		client: &acme.Client{Key: accountKey, DirectoryURL: a.DirectoryURL},
+		cache:  newS3Cache(cfg, a.CacheBucket, a.CachePrefix),
+	}
+
+	domain := wildcardDomain(cfg.Host.ReverseProxySuffix)
+	var cached *tls.Certificate
+	if cert, err := m.cache.loadCertificate(domain); err == nil {
+		m.mu.Lock()
+		m.cert = cert
+		m.mu.Unlock()
+		slog.Info("acme: loaded cached certificate from s3", "domain", domain)
+		cached = cert
+	}
+
+	go m.renewLoop(domain, a.Email, cached)
+	return m, nil
+}
+
+func wildcardDomain(reverseProxySuffix string) string {
+	return "*" + reverseProxySuffix
+}
+
+// TLSConfig returns a *tls.Config whose GetCertificate always serves the
+// manager's current wildcard cert.
+func (m *acmeManager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			m.mu.RLock()
+			cert := m.cert
+			m.mu.RUnlock()
+			if cert == nil {
+				return nil, fmt.Errorf("acme certificate for %s is not ready yet", hello.ServerName)
+			}
+			return cert, nil
+		},
+	}
+}
+
+// renewLoop issues the wildcard cert, caches it, sleeps until it's time to
+// renew, and repeats for as long as the process runs. If a still-fresh
+// certificate was already loaded from the S3 cache on startup, the first
+// iteration skips straight to sleeping until it needs renewal instead of
+// re-issuing immediately, so a fleet of restarting replicas shares one
+// issuance instead of racing Let's Encrypt's rate limits.
+func (m *acmeManager) renewLoop(domain, email string, cached *tls.Certificate) {
+	if cached != nil {
+		if d := timeUntilRenewal(cached); d > 0 {
+			slog.Info("acme: using cached certificate, deferring renewal", "domain", domain, "renew_in", d)
+			time.Sleep(d)
+		} else {
+			slog.Warn("acme: cached certificate is already due for renewal or expired, reissuing now", "domain", domain)
+		}
+	}
+
+	for {
+		cert, err := m.obtainCertificate(domain, email)
+		if err != nil {
+			slog.Error("acme: cannot obtain certificate", "domain", domain, "error", err)
+			time.Sleep(renewRetryInterval)
+			continue
+		}
+
+		m.mu.Lock()
+		m.cert = cert
+		m.mu.Unlock()
+
+		if err := m.cache.saveCertificate(domain, cert); err != nil {
+			slog.Warn("acme: cannot cache certificate in s3", "domain", domain, "error", err)
+		}
+
+		sleep := renewBefore(cert)
+		slog.Info("acme: certificate issued", "domain", domain, "renew_in", sleep)
+		time.Sleep(sleep)
+	}
+}
+
+// renewBefore schedules renewal 30 days before expiry, the same margin
+// most ACME clients use, clamped to a 1-hour minimum so a freshly issued
+// certificate doesn't immediately trigger another renewal attempt.
+func renewBefore(cert *tls.Certificate) time.Duration {
+	d := timeUntilRenewal(cert)
+	if d < time.Hour {
+		d = time.Hour
+	}
+	return d
+}
+
+// timeUntilRenewal reports how long until cert is due for renewal (30 days
+// before its expiry). Unlike renewBefore it is not clamped to a minimum, so
+// a zero or negative result means cert needs renewing right now, whether
+// because it's approaching expiry or already expired.
+func timeUntilRenewal(cert *tls.Certificate) time.Duration {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return 0
+	}
+	return time.Until(leaf.NotAfter) - 30*24*time.Hour
+}
+
+// obtainCertificate runs the ACME DNS-01 flow end to end: register the
+// account if needed, authorize the wildcard domain, satisfy its dns-01
+// challenge with a Route53 TXT record, then finalize the order.
+func (m *acmeManager) obtainCertificate(domain, email string) (*tls.Certificate, error) {
+	ctx := context.Background()
+
+	if _, err := m.client.Register(ctx, &acme.Account{Contact: []string{"mailto:" + email}}, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, fmt.Errorf("register acme account: %w", err)
+	}
+
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return nil, fmt.Errorf("authorize order for %s: %w", domain, err)
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		if err := m.completeDNS01(ctx, authzURL); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := m.client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, fmt.Errorf("wait for order to be ready: %w", err)
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate certificate key: %w", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, certKey)
+	if err != nil {
+		return nil, fmt.Errorf("create certificate request: %w", err)
+	}
+
+	der, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, fmt.Errorf("finalize order: %w", err)
+	}
+
+	return &tls.Certificate{Certificate: der, PrivateKey: certKey}, nil
+}
+
+// completeDNS01 satisfies one authorization's dns-01 challenge by
+// publishing the expected TXT record, waiting for Route53 to propagate
+// it, then telling the ACME server to (re)validate.
+func (m *acmeManager) completeDNS01(ctx context.Context, authzURL string) error {
+	authz, err := m.client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("get authorization %s: %w", authzURL, err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("no dns-01 challenge offered for %s", authz.Identifier.Value)
+	}
+
+	value, err := m.client.DNS01ChallengeRecord(challenge.Token)
+	if err != nil {
+		return fmt.Errorf("compute dns-01 record for %s: %w", authz.Identifier.Value, err)
+	}
+
+	recordName := "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.")
+	changeID, err := m.upsertTXT(recordName, value)
+	if err != nil {
+		return err
+	}
+	defer m.deleteTXT(recordName, value)
+
+	if err := m.waitRoute53Change(changeID); err != nil {
+		return err
+	}
+
+	if _, err := m.client.Accept(ctx, challenge); err != nil {
+		return fmt.Errorf("accept dns-01 challenge for %s: %w", authz.Identifier.Value, err)
+	}
+	if _, err := m.client.WaitAuthorization(ctx, authzURL); err != nil {
+		return fmt.Errorf("wait for authorization %s: %w", authzURL, err)
+	}
+	return nil
+}
+
+func (m *acmeManager) upsertTXT(name, value string) (string, error) {
+	return m.changeTXT(route53.ChangeActionUpsert, name, value)
+}
+
+func (m *acmeManager) deleteTXT(name, value string) {
+	if _, err := m.changeTXT(route53.ChangeActionDelete, name, value); err != nil {
+		slog.Warn("acme: cannot delete txt record", "name", name, "error", err)
+	}
+}
+
+func (m *acmeManager) changeTXT(action, name, value string) (string, error) {
+	svc := route53.New(m.cfg.session)
+	out, err := svc.ChangeResourceRecordSets(&route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(m.cfg.Link.HostedZoneID),
+		ChangeBatch: &route53.ChangeBatch{
+			Changes: []*route53.Change{
+				{
+					Action: aws.String(action),
+					ResourceRecordSet: &route53.ResourceRecordSet{
+						Name:            aws.String(name),
+						Type:            aws.String(route53.RRTypeTxt),
+						TTL:             aws.Int64(30),
+						ResourceRecords: []*route53.ResourceRecord{{Value: aws.String(strconv.Quote(value))}},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("%s txt record %s: %w", strings.ToLower(action), name, err)
+	}
+	return aws.StringValue(out.ChangeInfo.Id), nil
+}
+
+func (m *acmeManager) waitRoute53Change(changeID string) error {
+	svc := route53.New(m.cfg.session)
+	for i := 0; i < 30; i++ {
+		out, err := svc.GetChange(&route53.GetChangeInput{Id: aws.String(changeID)})
+		if err != nil {
+			return fmt.Errorf("get route53 change %s: %w", changeID, err)
+		}
+		if aws.StringValue(out.ChangeInfo.Status) == route53.ChangeStatusInsync {
+			return nil
+		}
+		time.Sleep(10 * time.Second)
+	}
+	return fmt.Errorf("route53 change %s did not become INSYNC in time", changeID)
+}
+
+// s3Cache persists issued certificates to S3, keyed by domain, so a
+// restart or a sibling replica can reuse them instead of re-issuing.
+type s3Cache struct {
+	svc    *s3.S3
+	bucket string
+	prefix string
+}
+
+func newS3Cache(cfg *Config, bucket, prefix string) *s3Cache {
+	return &s3Cache{svc: s3.New(cfg.session), bucket: bucket, prefix: prefix}
+}
+
+func (c *s3Cache) key(domain string) string {
+	return path.Join(c.prefix, strings.ReplaceAll(domain, "*", "_wildcard_")+".pem")
+}
+
+func (c *s3Cache) loadCertificate(domain string) (*tls.Certificate, error) {
+	out, err := c.svc.GetObject(&s3.GetObjectInput{Bucket: aws.String(c.bucket), Key: aws.String(c.key(domain))})
+	if err != nil {
+		return nil, fmt.Errorf("get s3://%s/%s: %w", c.bucket, c.key(domain), err)
+	}
+	defer out.Body.Close()
+	data, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, err
+	}
+	return certFromPEMBundle(data)
+}
+
+func (c *s3Cache) saveCertificate(domain string, cert *tls.Certificate) error {
+	data, err := pemBundleFromCert(cert)
+	if err != nil {
+		return err
+	}
+	_, err = c.svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(c.key(domain)),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+func pemBundleFromCert(cert *tls.Certificate) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, der := range cert.Certificate {
+		if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+			return nil, err
+		}
+	}
+	key, ok := cert.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", cert.PrivateKey)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func certFromPEMBundle(data []byte) (*tls.Certificate, error) {
+	var certDER [][]byte
+	var keyDER []byte
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "CERTIFICATE":
+			certDER = append(certDER, block.Bytes)
+		case "EC PRIVATE KEY":
+			keyDER = block.Bytes
+		}
+	}
+	if len(certDER) == 0 || keyDER == nil {
+		return nil, fmt.Errorf("pem bundle is missing a certificate or private key")
+	}
+	key, err := x509.ParseECPrivateKey(keyDER)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: certDER, PrivateKey: key}, nil
+}
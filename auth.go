@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// AuthMethod selects which authenticator ServeHTTPWithPort enforces for a
+// subdomain before a request reaches the backend.
+type AuthMethod string
+
+const (
+	AuthNone  AuthMethod = ""
+	AuthBasic AuthMethod = "basic"
+	AuthToken AuthMethod = "token"
+	AuthOIDC  AuthMethod = "oidc"
+)
+
+// Auth is the access-control configuration for a subdomain. It can be set
+// globally on Config, applying to every subdomain by default, and
+// overridden per subdomain via the AddSubdomain control message's Auth
+// field.
+type Auth struct {
+	Method      AuthMethod `yaml:"method"`
+	Basic       *BasicAuth `yaml:"basic"`
+	Token       *TokenAuth `yaml:"token"`
+	OIDC        *OIDCAuth  `yaml:"oidc"`
+	BypassCIDRs []string   `yaml:"bypass_cidrs"`
+}
+
+// BasicAuth checks credentials against a static, config-declared user list.
+type BasicAuth struct {
+	Users map[string]string `yaml:"users"` // username -> password
+}
+
+// TokenAuth checks a shared bearer token carried in a cookie or header.
+type TokenAuth struct {
+	CookieName string `yaml:"cookie_name"`
+	HeaderName string `yaml:"header_name"`
+	Secret     string `yaml:"secret"`
+}
+
+const (
+	defaultTokenCookieName = "TokenSecretID"
+	defaultTokenHeaderName = "Authorization"
+)
+
+// authenticator enforces one subdomain's Auth configuration.
+type authenticator struct {
+	auth   Auth
+	bypass []*net.IPNet
+	oidc   *oidcAuthenticator
+}
+
+// newAuthenticator builds an authenticator for auth, or nil when no
+// authentication is configured. cookieDomain is the reverse proxy suffix
+// shared by every subdomain (Host.ReverseProxySuffix); for AuthOIDC it is
+// used to scope the session cookie so a login performed at the provider's
+// one fixed callback host is still valid once the browser is redirected
+// back to whichever preview subdomain started the flow.
+func newAuthenticator(auth Auth, cookieDomain string) *authenticator {
+	if auth.Method == AuthNone {
+		return nil
+	}
+	a := &authenticator{auth: auth}
+	for _, cidr := range auth.BypassCIDRs {
+		if _, n, err := net.ParseCIDR(cidr); err == nil {
+			a.bypass = append(a.bypass, n)
+		} else {
+			slog.Warn("invalid auth bypass_cidrs entry", "cidr", cidr, "error", err)
+		}
+	}
+	if auth.Method == AuthOIDC {
+		if auth.OIDC == nil {
+			slog.Error("auth method is oidc but no oidc block is configured")
+			return a
+		}
+		o, err := newOIDCAuthenticator(*auth.OIDC, cookieDomain)
+		if err != nil {
+			slog.Error("cannot initialize oidc authenticator", "error", err)
+		}
+		a.oidc = o
+	}
+	return a
+}
+
+// bypasses reports whether req's remote address matches one of the
+// configured bypass CIDRs, e.g. an internal health checker.
+func (a *authenticator) bypasses(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range a.bypass {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate reports whether req is authorized to reach the subdomain.
+// On failure it writes the response itself (401 for basic/token auth, or
+// an OIDC redirect) unless isUpgrade is set, in which case it always
+// responds 401 since a WebSocket handshake can't be hijacked after a
+// redirect has been written.
+func (a *authenticator) Authenticate(w http.ResponseWriter, req *http.Request, isUpgrade bool) bool {
+	if a.bypasses(req) {
+		return true
+	}
+	switch a.auth.Method {
+	case AuthBasic:
+		return a.authenticateBasic(w, req)
+	case AuthToken:
+		return a.authenticateToken(w, req)
+	case AuthOIDC:
+		if a.oidc == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return false
+		}
+		if isUpgrade {
+			if sess, ok := a.oidc.validSession(req); ok && a.oidc.cfg.isAllowed(sess.Email, sess.Groups) {
+				return true
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return false
+		}
+		return a.oidc.Authenticate(w, req)
+	default:
+		return true
+	}
+}
+
+func (a *authenticator) authenticateBasic(w http.ResponseWriter, req *http.Request) bool {
+	if a.auth.Basic != nil {
+		if user, pass, ok := req.BasicAuth(); ok {
+			if want, exists := a.auth.Basic.Users[user]; exists &&
+				subtle.ConstantTimeCompare([]byte(pass), []byte(want)) == 1 {
+				return true
+			}
+		}
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="mirage-ecs"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+func (a *authenticator) authenticateToken(w http.ResponseWriter, req *http.Request) bool {
+	if a.auth.Token != nil {
+		if token := a.tokenFromRequest(req); token != "" &&
+			subtle.ConstantTimeCompare([]byte(token), []byte(a.auth.Token.Secret)) == 1 {
+			return true
+		}
+	}
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+func (a *authenticator) tokenFromRequest(req *http.Request) string {
+	headerName := a.auth.Token.HeaderName
+	if headerName == "" {
+		headerName = defaultTokenHeaderName
+	}
+	if token := req.Header.Get(headerName); token != "" {
+		// The default header is Authorization, whose conventional form is
+		// "Bearer <token>"; strip that scheme prefix so clients sending
+		// either the raw secret or a standard bearer header both match.
+		if strings.HasPrefix(token, "Bearer ") {
+			return strings.TrimPrefix(token, "Bearer ")
+		}
+		return token
+	}
+	cookieName := a.auth.Token.CookieName
+	if cookieName == "" {
+		cookieName = defaultTokenCookieName
+	}
+	if c, err := req.Cookie(cookieName); err == nil {
+		return c.Value
+	}
+	return ""
+}
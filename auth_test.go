@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticateBasic(t *testing.T) {
+	a := newAuthenticator(Auth{
+		Method: AuthBasic,
+		Basic:  &BasicAuth{Users: map[string]string{"alice": "s3cret"}},
+	}, "")
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth("alice", "s3cret")
+	if ok := a.Authenticate(httptest.NewRecorder(), req, false); !ok {
+		t.Error("expected valid credentials to authenticate")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth("alice", "wrong")
+	rec := httptest.NewRecorder()
+	if ok := a.Authenticate(rec, req, false); ok {
+		t.Error("expected wrong password to be rejected")
+	}
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAuthenticateTokenHeader(t *testing.T) {
+	a := newAuthenticator(Auth{
+		Method: AuthToken,
+		Token:  &TokenAuth{Secret: "topsecret"},
+	}, "")
+
+	cases := []struct {
+		name   string
+		header string
+		want   bool
+	}{
+		{"raw secret", "topsecret", true},
+		{"bearer-prefixed secret", "Bearer topsecret", true},
+		{"wrong secret", "nope", false},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(defaultTokenHeaderName, c.header)
+		if got := a.Authenticate(httptest.NewRecorder(), req, false); got != c.want {
+			t.Errorf("%s: Authenticate() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestAuthenticateTokenCookie(t *testing.T) {
+	a := newAuthenticator(Auth{
+		Method: AuthToken,
+		Token:  &TokenAuth{Secret: "topsecret"},
+	}, "")
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: defaultTokenCookieName, Value: "topsecret"})
+	if ok := a.Authenticate(httptest.NewRecorder(), req, false); !ok {
+		t.Error("expected matching cookie token to authenticate")
+	}
+}
+
+func TestAuthenticateBypassCIDR(t *testing.T) {
+	a := newAuthenticator(Auth{
+		Method:      AuthBasic,
+		Basic:       &BasicAuth{Users: map[string]string{"alice": "s3cret"}},
+		BypassCIDRs: []string{"10.0.0.0/8"},
+	}, "")
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.1.2.3:1234"
+	if ok := a.Authenticate(httptest.NewRecorder(), req, false); !ok {
+		t.Error("expected request from bypass CIDR to authenticate without credentials")
+	}
+}
+
+func TestNewAuthenticatorNone(t *testing.T) {
+	if a := newAuthenticator(Auth{Method: AuthNone}, ""); a != nil {
+		t.Errorf("expected nil authenticator for AuthNone, got %#v", a)
+	}
+}
@@ -5,10 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"path"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -24,6 +27,9 @@ type Config struct {
 	Parameter Paramters `yaml:"parameters"`
 	ECS       ECSCfg    `yaml:"ecs"`
 	Link      Link      `yaml:"link"`
+	Egress    Egress    `yaml:"egress"`
+	Auth      Auth      `yaml:"auth"`
+	Telemetry Telemetry `yaml:"telemetry"`
 
 	localMode bool
 	session   *session.Session
@@ -140,11 +146,151 @@ type Listen struct {
 	ForeignAddress string    `yaml:"foreign_address"`
 	HTTP           []PortMap `yaml:"http"`
 	HTTPS          []PortMap `yaml:"https"`
+	TLS            TLSConfig `yaml:"tls"`
+}
+
+// TLSConfig selects how HTTPS listeners terminate TLS: either a static
+// wildcard cert (CertSource "static") loaded from a file or an AWS
+// Secrets Manager / SSM Parameter Store ARN, or one issued and renewed
+// automatically via ACME (CertSource "acme").
+type TLSConfig struct {
+	CertSource        string      `yaml:"cert_source"`
+	CertFile          string      `yaml:"cert_file"`
+	KeyFile           string      `yaml:"key_file"`
+	CertSecretARN     string      `yaml:"cert_secret_arn"`
+	ACME              *ACMEConfig `yaml:"acme"`
+	RedirectHTTP      bool        `yaml:"redirect_http"`
+	HSTS              bool        `yaml:"hsts"`
+	HSTSMaxAgeSeconds int         `yaml:"hsts_max_age_seconds"`
+}
+
+const (
+	TLSCertSourceStatic = "static"
+	TLSCertSourceACME   = "acme"
+)
+
+// ACMEConfig drives automatic issuance via ACME DNS-01 against the
+// Link.HostedZoneID Route53 zone for Host.ReverseProxySuffix. Issued
+// certs are cached in CacheBucket so restarts and multi-replica
+// deployments of mirage-ecs share them instead of re-issuing.
+type ACMEConfig struct {
+	DirectoryURL string `yaml:"directory_url"`
+	Email        string `yaml:"email"`
+	CacheBucket  string `yaml:"cache_bucket"`
+	CachePrefix  string `yaml:"cache_prefix"`
 }
 
 type PortMap struct {
-	ListenPort int `yaml:"listen"`
-	TargetPort int `yaml:"target"`
+	ListenPort int    `yaml:"listen"`
+	TargetPort int    `yaml:"target"`
+	Protocol   string `yaml:"protocol"`
+
+	// HealthCheckPath, if set, enables an active liveness probe: mirage
+	// periodically issues an HTTP GET against it and ejects the backend
+	// when the response stops matching HealthCheckExpectedStatus.
+	HealthCheckPath            string `yaml:"health_check_path"`
+	HealthCheckIntervalSeconds int    `yaml:"health_check_interval_seconds"`
+	HealthCheckExpectedStatus  int    `yaml:"health_check_expected_status"`
+}
+
+// protocols supported by a PortMap's Protocol field.
+const (
+	ProtocolHTTP      = "http"
+	ProtocolH2C       = "h2c"
+	ProtocolWebSocket = "websocket"
+	ProtocolAuto      = "auto"
+)
+
+// protocol returns the configured protocol, defaulting to ProtocolAuto when unset.
+func (p PortMap) protocol() string {
+	switch p.Protocol {
+	case ProtocolHTTP, ProtocolH2C, ProtocolWebSocket, ProtocolAuto:
+		return p.Protocol
+	case "":
+		return ProtocolAuto
+	default:
+		slog.Warn("unknown protocol, falling back to default", "protocol", p.Protocol, "listen_port", p.ListenPort, "default", ProtocolAuto)
+		return ProtocolAuto
+	}
+}
+
+// healthCheck returns the PortMap's active health check configuration, or
+// nil when HealthCheckPath is unset and no probing should happen.
+func (p PortMap) healthCheck() *HealthCheck {
+	if p.HealthCheckPath == "" {
+		return nil
+	}
+	interval := time.Duration(p.HealthCheckIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	expectedStatus := p.HealthCheckExpectedStatus
+	if expectedStatus == 0 {
+		expectedStatus = http.StatusOK
+	}
+	return &HealthCheck{
+		Path:           p.HealthCheckPath,
+		Interval:       interval,
+		ExpectedStatus: expectedStatus,
+	}
+}
+
+// Egress configures the CONNECT-capable forward proxy that ECS tasks can
+// point HTTPS_PROXY at. A destination is allowed only when it matches the
+// host pattern and port of at least one rule; everything else is denied
+// and logged, giving preview environments the same "known external
+// dependencies only" guardrail production service meshes provide.
+type Egress struct {
+	Listen string       `yaml:"listen"`
+	Rules  []EgressRule `yaml:"rules"`
+}
+
+type EgressRule struct {
+	Hosts []string     `yaml:"hosts"`
+	Ports []EgressPort `yaml:"ports"`
+}
+
+// EgressPort is a single allowed destination port. There is no Protocol
+// field: a CONNECT proxy only ever sees an opaque TCP tunnel to host:port,
+// so it has no way to verify the application protocol running inside it
+// without deep packet inspection, and a field nothing checks would only
+// mislead operators into thinking it constrains something.
+type EgressPort struct {
+	Port int `yaml:"port"`
+}
+
+// allows reports whether host:port matches at least one configured rule.
+// Host patterns are matched with path.Match, so "*.example.com" allows
+// any subdomain, nested ones included, the same way subdomain routing
+// patterns do.
+func (e Egress) allows(host string, port int) bool {
+	for _, rule := range e.Rules {
+		if !rule.matchesHost(host) {
+			continue
+		}
+		if rule.matchesPort(port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r EgressRule) matchesHost(host string) bool {
+	for _, pattern := range r.Hosts {
+		if m, _ := path.Match(pattern, host); m {
+			return true
+		}
+	}
+	return false
+}
+
+func (r EgressRule) matchesPort(port int) bool {
+	for _, p := range r.Ports {
+		if p.Port == port {
+			return true
+		}
+	}
+	return false
 }
 
 type Parameter struct {
@@ -158,7 +304,7 @@ type Parameter struct {
 type Paramters []*Parameter
 
 func NewConfig(path string) *Config {
-	log.Printf("[info] loading config file: %s", path)
+	slog.Info("loading config file", "path", path)
 	// default config
 	cfg := &Config{
 		Host: Host{
@@ -192,7 +338,7 @@ func NewConfig(path string) *Config {
 	cfg.ECS.networkConfiguration = cfg.ECS.NetworkConfiguration.toSDK()
 
 	if err := cfg.fillECSDefaults(context.TODO()); err != nil {
-		log.Printf("[warn] failed to fill ECS defaults: %s", err)
+		slog.Warn("failed to fill ECS defaults", "error", err)
 	}
 	return cfg
 }
@@ -200,25 +346,24 @@ func NewConfig(path string) *Config {
 func (c *Config) fillECSDefaults(ctx context.Context) error {
 	defer func() {
 		if c.ECS.valid() {
-			log.Printf("[info] built ECS config: %s", c.ECS)
+			slog.Info("built ECS config", "ecs", c.ECS.String())
 		} else {
-			log.Printf("[error] invalid ECS config: %s", c.ECS)
-			log.Println("[error] ECS config is invalid, so you may not be able to launch ECS tasks")
+			slog.Error("invalid ECS config, may not be able to launch ECS tasks", "ecs", c.ECS.String())
 		}
 	}()
 	if c.ECS.Region == "" {
 		c.ECS.Region = os.Getenv("AWS_REGION")
-		log.Printf("[info] AWS_REGION is not set, using region=%s", c.ECS.Region)
+		slog.Info("AWS_REGION is not set, using environment value", "region", c.ECS.Region)
 	}
 	if c.ECS.LaunchType == nil && c.ECS.CapacityProviderStrategy == nil {
 		launchType := "FARGATE"
 		c.ECS.LaunchType = &launchType
-		log.Printf("[info] launch_type and capacity_provider_strategy are not set, using launch_type=%s", *c.ECS.LaunchType)
+		slog.Info("launch_type and capacity_provider_strategy are not set, using default", "launch_type", *c.ECS.LaunchType)
 	}
 	if c.ECS.EnableExecuteCommand == nil {
 		enableExecuteCommand := true
 		c.ECS.EnableExecuteCommand = &enableExecuteCommand
-		log.Printf("[info] enable_execute_command is not set, using enable_execute_command=%t", *c.ECS.EnableExecuteCommand)
+		slog.Info("enable_execute_command is not set, using default", "enable_execute_command", *c.ECS.EnableExecuteCommand)
 	}
 
 	meta, err := metadata.Get(ctx, &http.Client{})
@@ -232,7 +377,7 @@ func (c *Config) fillECSDefaults(ctx context.Context) error {
 			}
 		*/
 	}
-	log.Printf("[debug] task metadata: %v", meta)
+	slog.Debug("task metadata", "metadata", meta)
 	var cluster, taskArn, service string
 	switch m := meta.(type) {
 	case *metadata.TaskMetadataV3:
@@ -269,7 +414,7 @@ func (c *Config) fillECSDefaults(ctx context.Context) error {
 		}
 		if c.ECS.networkConfiguration == nil {
 			c.ECS.networkConfiguration = out.Services[0].NetworkConfiguration
-			log.Printf("[info] network_configuration is not set, using network_configuration=%v", c.ECS.networkConfiguration)
+			slog.Info("network_configuration is not set, using service's network_configuration", "network_configuration", c.ECS.networkConfiguration)
 		}
 	}
 	return nil
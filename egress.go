@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// egressProxy is the CONNECT-capable forward proxy ECS tasks can point
+// HTTPS_PROXY at. Only destinations matching one of cfg.Egress's rules are
+// dialed; everything else is rejected with 403 and logged so operators can
+// see which external hosts a preview task tried to reach.
+type egressProxy struct {
+	cfg *Config
+}
+
+// NewEgressProxy returns the forward-proxy handler for cfg.Egress.
+func NewEgressProxy(cfg *Config) http.Handler {
+	return &egressProxy{cfg: cfg}
+}
+
+func (p *egressProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodConnect {
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	host, portStr, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	if !p.cfg.Egress.allows(host, port) {
+		slog.Warn("egress denied", "host", host, "port", port)
+		http.Error(w, "destination not allowed", http.StatusForbidden)
+		return
+	}
+
+	target, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		slog.Error("cannot dial egress target", "target", req.Host, "error", err)
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	client, _, err := hijacker.Hijack()
+	if err != nil {
+		slog.Error("cannot hijack egress client connection", "error", err)
+		return
+	}
+	defer client.Close()
+
+	slog.Info("egress allowed", "host", host, "port", port)
+	fmt.Fprint(client, "HTTP/1.1 200 Connection Established\r\n\r\n")
+
+	done := make(chan struct{}, 2)
+	go copyAndClose(done, target, client)
+	go copyAndClose(done, client, target)
+	<-done
+	<-done
+}
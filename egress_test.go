@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestEgressAllows(t *testing.T) {
+	e := Egress{
+		Rules: []EgressRule{
+			{
+				Hosts: []string{"*.example.com", "api.stripe.com"},
+				Ports: []EgressPort{{Port: 443}},
+			},
+		},
+	}
+
+	cases := []struct {
+		host string
+		port int
+		want bool
+	}{
+		{"api.example.com", 443, true},
+		{"api.stripe.com", 443, true},
+		{"api.example.com", 80, false},
+		{"evil.com", 443, false},
+		{"example.com", 443, false}, // "*.example.com" requires a subdomain
+	}
+	for _, c := range cases {
+		if got := e.allows(c.host, c.port); got != c.want {
+			t.Errorf("allows(%q, %d) = %v, want %v", c.host, c.port, got, c.want)
+		}
+	}
+}
+
+func TestEgressRuleMatchesHost(t *testing.T) {
+	r := EgressRule{Hosts: []string{"*.example.com"}}
+	if !r.matchesHost("foo.example.com") {
+		t.Error("expected wildcard to match a subdomain")
+	}
+	// path.Match's "*" only treats "/" as a separator, so it happily
+	// crosses "." boundaries too, same as the subdomain routing patterns
+	// elsewhere in this codebase.
+	if !r.matchesHost("foo.bar.example.com") {
+		t.Error("expected wildcard to match a nested subdomain")
+	}
+	if r.matchesHost("example.org") {
+		t.Error("unrelated host should not match")
+	}
+}
+
+func TestEgressRuleMatchesPort(t *testing.T) {
+	r := EgressRule{Ports: []EgressPort{{Port: 443}, {Port: 8443}}}
+	if !r.matchesPort(443) || !r.matchesPort(8443) {
+		t.Error("expected configured ports to match")
+	}
+	if r.matchesPort(80) {
+		t.Error("expected unconfigured port to not match")
+	}
+}
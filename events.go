@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/mashiike/mirage-ecs/pkg/events"
+)
+
+const eventsHeartbeatInterval = 15 * time.Second
+
+// NewEventsHandler returns the GET /events SSE endpoint that streams
+// ProxyEvents from bus. A client can resume after a disconnect by sending
+// either a Last-Event-ID header or a ?since= query parameter with the
+// cursor of the last event it saw; everything published in between is
+// replayed from the bus's backlog before the stream goes live. Periodic
+// heartbeat comments keep the connection from being reaped by idle
+// timeouts while nothing is happening.
+//
+// TODO: ?format=grpc is currently a 501 stub, not the real gRPC streaming
+// endpoint the "second endpoint" design called for; only SSE is actually
+// implemented.
+func NewEventsHandler(bus *events.Bus) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("format") == "grpc" {
+			// A real gRPC streaming service is future work; for now grpc
+			// clients get an explicit 501 instead of silently falling
+			// back to SSE.
+			http.Error(w, "grpc event streaming is not implemented yet, use the default SSE format", http.StatusNotImplemented)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		var since uint64
+		if id := req.Header.Get("Last-Event-ID"); id != "" {
+			fmt.Sscanf(id, "%d", &since)
+		} else if s := req.URL.Query().Get("since"); s != "" {
+			fmt.Sscanf(s, "%d", &since)
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		ctx := req.Context()
+		stream, unsubscribe := bus.Subscribe(ctx, since)
+		defer unsubscribe()
+
+		heartbeat := time.NewTicker(eventsHeartbeatInterval)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-stream:
+				if !ok {
+					return
+				}
+				b, err := json.Marshal(ev)
+				if err != nil {
+					slog.Error("cannot marshal proxy event", "error", err)
+					continue
+				}
+				fmt.Fprintf(w, "id: %d\nevent: proxy\ndata: %s\n\n", ev.Cursor, b)
+				flusher.Flush()
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": heartbeat\n\n")
+				flusher.Flush()
+			}
+		}
+	}
+}
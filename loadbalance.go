@@ -0,0 +1,164 @@
+package main
+
+import (
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// loadBalancePolicy picks which backend of a subdomain's live set serves
+// the next request.
+type loadBalancePolicy string
+
+const (
+	lbRandom     loadBalancePolicy = "random"
+	lbRoundRobin loadBalancePolicy = "round_robin"
+	lbLeastConn  loadBalancePolicy = "least_conn"
+	lbWeighted   loadBalancePolicy = "weighted"
+
+	defaultLoadBalancePolicy = lbRandom
+
+	// outlier detection: eject a backend after this many consecutive 5xx
+	// responses, for this long, regardless of what the idle timer or
+	// active health check say.
+	outlierConsecutive5xxThreshold = 5
+	outlierEjectionCooldown        = 30 * time.Second
+)
+
+func parseLoadBalancePolicy(s string) loadBalancePolicy {
+	switch loadBalancePolicy(s) {
+	case lbRandom, lbRoundRobin, lbLeastConn, lbWeighted:
+		return loadBalancePolicy(s)
+	case "":
+		return defaultLoadBalancePolicy
+	default:
+		slog.Warn("unknown load_balance policy, falling back to default", "policy", s, "default", defaultLoadBalancePolicy)
+		return defaultLoadBalancePolicy
+	}
+}
+
+// HealthCheck is the active liveness probe configuration for a backend,
+// analogous to an ECS target group health check.
+type HealthCheck struct {
+	Path           string
+	Interval       time.Duration
+	ExpectedStatus int
+}
+
+// subdomainRoutes holds every backend known for one subdomain, plus the
+// load-balancing policy and round-robin state used to pick among them and
+// the authenticator (if any) ServeHTTPWithPort must satisfy first. mu guards
+// handlers and rrCounters so that picking a backend for this subdomain
+// doesn't have to contend with every other subdomain's requests for a
+// single proxy-wide lock.
+type subdomainRoutes struct {
+	mu            sync.Mutex
+	handlers      proxyHandlers
+	loadBalance   loadBalancePolicy
+	rrCounters    map[int]*uint64
+	authenticator *authenticator
+}
+
+func newSubdomainRoutes(lb loadBalancePolicy) *subdomainRoutes {
+	return &subdomainRoutes{
+		handlers:    make(proxyHandlers),
+		loadBalance: lb,
+		rrCounters:  make(map[int]*uint64),
+	}
+}
+
+// liveHandlers returns the backends currently eligible to serve, pruning
+// only the ones whose idle timer has genuinely expired. A backend that's
+// merely failing its active health check or sitting out an outlier-ejection
+// cooldown is left in handlers (with its health-check goroutine still
+// running) so it can rejoin the candidate list on its own once alive()
+// passes again, instead of being closed and requiring the whole task to be
+// re-added from scratch.
+func (sr *subdomainRoutes) liveHandlers(port int) []*proxyHandler {
+	handlers := sr.handlers[port]
+	if len(handlers) == 0 {
+		return nil
+	}
+	live := make([]*proxyHandler, 0, len(handlers))
+	for ipaddress, h := range handlers {
+		if h.timedOut() {
+			slog.Info("proxy handler timed out, removing", "ip", ipaddress)
+			h.close()
+			delete(handlers, ipaddress)
+			continue
+		}
+		if h.alive() {
+			live = append(live, h)
+		}
+	}
+	return live
+}
+
+// Handler picks a backend for port according to the subdomain's configured
+// load-balancing policy, returning its handler along with the backend's IP
+// address so callers can attribute a request to it (e.g. in access logs).
+// It takes sr.mu itself, not the caller's lock: liveHandlers prunes
+// sr.handlers and round-robin picks mutate sr.rrCounters, neither of which
+// is safe for concurrent access from multiple requests against this
+// subdomain.
+func (sr *subdomainRoutes) Handler(port int) (http.Handler, string, bool) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	candidates := sr.liveHandlers(port)
+	if len(candidates) == 0 {
+		return nil, "", false
+	}
+
+	var chosen *proxyHandler
+	switch sr.loadBalance {
+	case lbRoundRobin:
+		counter, ok := sr.rrCounters[port]
+		if !ok {
+			counter = new(uint64)
+			sr.rrCounters[port] = counter
+		}
+		n := atomic.AddUint64(counter, 1)
+		chosen = candidates[(n-1)%uint64(len(candidates))]
+	case lbLeastConn:
+		chosen = candidates[0]
+		for _, c := range candidates[1:] {
+			if atomic.LoadInt64(&c.activeConns) < atomic.LoadInt64(&chosen.activeConns) {
+				chosen = c
+			}
+		}
+	case lbWeighted:
+		chosen = weightedPick(candidates)
+	default: // lbRandom
+		chosen = candidates[rand.Intn(len(candidates))]
+	}
+	return chosen.handler, chosen.ip, true
+}
+
+// weightedPick does a weighted-random draw, treating any backend with a
+// non-positive weight as weight 1.
+func weightedPick(candidates []*proxyHandler) *proxyHandler {
+	total := 0
+	for _, c := range candidates {
+		total += normalizeWeight(c.weight)
+	}
+	r := rand.Intn(total)
+	for _, c := range candidates {
+		w := normalizeWeight(c.weight)
+		if r < w {
+			return c
+		}
+		r -= w
+	}
+	return candidates[len(candidates)-1]
+}
+
+func normalizeWeight(w int) int {
+	if w <= 0 {
+		return 1
+	}
+	return w
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseLoadBalancePolicy(t *testing.T) {
+	cases := map[string]loadBalancePolicy{
+		"":            defaultLoadBalancePolicy,
+		"random":      lbRandom,
+		"round_robin": lbRoundRobin,
+		"least_conn":  lbLeastConn,
+		"weighted":    lbWeighted,
+		"bogus":       defaultLoadBalancePolicy,
+	}
+	for in, want := range cases {
+		if got := parseLoadBalancePolicy(in); got != want {
+			t.Errorf("parseLoadBalancePolicy(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestWeightedPickDistribution(t *testing.T) {
+	heavy := &proxyHandler{weight: 9}
+	light := &proxyHandler{weight: 1}
+	candidates := []*proxyHandler{heavy, light}
+
+	var heavyCount int
+	const draws = 10000
+	for i := 0; i < draws; i++ {
+		if weightedPick(candidates) == heavy {
+			heavyCount++
+		}
+	}
+
+	// heavy has 9x the weight of light, so it should win roughly 90% of
+	// draws; allow a generous margin since this is a random draw.
+	if got := float64(heavyCount) / draws; got < 0.8 || got > 0.98 {
+		t.Errorf("heavy backend won %.2f of draws, want ~0.90", got)
+	}
+}
+
+func TestLiveHandlersExcludesUnhealthyButKeepsItRegistered(t *testing.T) {
+	sr := newSubdomainRoutes(lbRandom)
+	h := &proxyHandler{timer: time.NewTimer(time.Hour), ip: "10.0.0.1", healthy: 0}
+	sr.handlers[80] = map[string]*proxyHandler{"10.0.0.1": h}
+
+	if live := sr.liveHandlers(80); len(live) != 0 {
+		t.Fatalf("expected no live candidates for an unhealthy backend, got %d", len(live))
+	}
+	if _, ok := sr.handlers[80]["10.0.0.1"]; !ok {
+		t.Fatal("unhealthy backend should stay registered so it can recover")
+	}
+
+	atomic.StoreInt32(&h.healthy, 1)
+	if live := sr.liveHandlers(80); len(live) != 1 {
+		t.Errorf("expected backend to rejoin candidates once healthy again, got %d", len(live))
+	}
+}
+
+func TestLiveHandlersPrunesTimedOutBackend(t *testing.T) {
+	sr := newSubdomainRoutes(lbRandom)
+	h := &proxyHandler{timer: time.NewTimer(time.Millisecond), ip: "10.0.0.2", healthy: 1}
+	sr.handlers[80] = map[string]*proxyHandler{"10.0.0.2": h}
+
+	time.Sleep(5 * time.Millisecond)
+	if live := sr.liveHandlers(80); len(live) != 0 {
+		t.Errorf("expected no live candidates after idle timeout, got %d", len(live))
+	}
+	if _, ok := sr.handlers[80]["10.0.0.2"]; ok {
+		t.Error("timed-out backend should be pruned from handlers")
+	}
+}
+
+func TestNormalizeWeight(t *testing.T) {
+	cases := map[int]int{
+		5:  5,
+		1:  1,
+		0:  1,
+		-3: 1,
+	}
+	for in, want := range cases {
+		if got := normalizeWeight(in); got != want {
+			t.Errorf("normalizeWeight(%d) = %d, want %d", in, got, want)
+		}
+	}
+}
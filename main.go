@@ -1,16 +1,36 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"strings"
 
-	"github.com/hashicorp/logutils"
 	"gopkg.in/yaml.v2"
 )
 
+// levelTrace sits one notch below slog.LevelDebug; parseLogLevel maps
+// "-log-level trace" to it, since slog has no built-in trace level.
+const levelTrace = slog.Level(-8)
+
+func parseLogLevel(s string) slog.Level {
+	switch s {
+	case "trace":
+		return levelTrace
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
 var (
 	version   string
 	buildDate string
@@ -35,14 +55,10 @@ func main() {
 		return
 	}
 
-	filter := &logutils.LevelFilter{
-		Levels:   []logutils.LogLevel{"trace", "debug", "info", "warn", "error"},
-		MinLevel: logutils.LogLevel(*logLevel),
-		Writer:   os.Stderr,
-	}
-	log.SetOutput(filter)
-	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
-	log.Printf("[debug] setting log level: %s", *logLevel)
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: parseLogLevel(*logLevel),
+	})))
+	slog.Debug("setting log level", "level", *logLevel)
 
 	cfg, err := NewConfig(&ConfigParams{
 		Path:        *confFile,
@@ -57,6 +73,12 @@ func main() {
 		yaml.NewEncoder(os.Stdout).Encode(cfg)
 		return
 	}
+	shutdown, err := SetupTelemetry(context.Background(), cfg)
+	if err != nil {
+		log.Fatalf("[error] cannot set up telemetry: %s", err)
+	}
+	defer shutdown(context.Background())
+
 	Setup(cfg)
 	Run()
 }
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// OIDCAuth drives an OIDC authorization-code redirect flow, storing the
+// resulting identity in a signed session cookie.
+type OIDCAuth struct {
+	ProviderURL   string   `yaml:"provider_url"`
+	ClientID      string   `yaml:"client_id"`
+	ClientSecret  string   `yaml:"client_secret"`
+	RedirectURL   string   `yaml:"redirect_url"`
+	CookieSecret  string   `yaml:"cookie_secret"`
+	AllowedEmails []string `yaml:"allowed_emails"`
+	AllowedGroups []string `yaml:"allowed_groups"`
+}
+
+func (c OIDCAuth) isAllowed(email string, groups []string) bool {
+	if len(c.AllowedEmails) == 0 && len(c.AllowedGroups) == 0 {
+		return true
+	}
+	for _, e := range c.AllowedEmails {
+		if strings.EqualFold(e, email) {
+			return true
+		}
+	}
+	for _, want := range c.AllowedGroups {
+		for _, g := range groups {
+			if g == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+const (
+	oidcCallbackPath  = "/_mirage/oidc/callback"
+	oidcStateCookie   = "mirage_oidc_state"
+	oidcSessionCookie = "mirage_oidc_session"
+	oidcSessionTTL    = 12 * time.Hour
+)
+
+type oidcSession struct {
+	Email   string    `json:"email"`
+	Groups  []string  `json:"groups"`
+	Expires time.Time `json:"expires"`
+}
+
+// oidcAuthenticator implements the redirect flow for one OIDCAuth config:
+// unauthenticated requests are sent to the provider's authorization
+// endpoint, the callback exchanges the code for an ID token, and the
+// resulting identity is cached in a signed session cookie so the provider
+// isn't contacted again until the session expires.
+type oidcAuthenticator struct {
+	cfg      OIDCAuth
+	verifier *oidc.IDTokenVerifier
+	oauth2   oauth2.Config
+
+	// cookieDomain scopes the state/session cookies to every subdomain
+	// under it (e.g. ".dev.example.net"), rather than just the one fixed
+	// host the OIDC provider calls back to. Without it, the session set at
+	// the callback host is never sent back to the preview subdomain the
+	// browser is redirected to, and login loops forever.
+	cookieDomain string
+}
+
+func newOIDCAuthenticator(cfg OIDCAuth, cookieDomain string) (*oidcAuthenticator, error) {
+	provider, err := oidc.NewProvider(context.Background(), cfg.ProviderURL)
+	if err != nil {
+		return nil, fmt.Errorf("discover oidc provider %s: %w", cfg.ProviderURL, err)
+	}
+	return &oidcAuthenticator{
+		cfg:      cfg,
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+		oauth2: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "email", "profile", "groups"},
+		},
+		cookieDomain: cookieDomain,
+	}, nil
+}
+
+// Authenticate reports whether req carries a valid session. It always
+// writes a response when it returns false: the OIDC callback's result, a
+// 403 for a session that is not on the allow-list, or a redirect to the
+// provider's authorization endpoint.
+func (o *oidcAuthenticator) Authenticate(w http.ResponseWriter, req *http.Request) bool {
+	if req.URL.Path == oidcCallbackPath {
+		o.handleCallback(w, req)
+		return false
+	}
+	if sess, ok := o.validSession(req); ok {
+		if o.cfg.isAllowed(sess.Email, sess.Groups) {
+			return true
+		}
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	o.redirectToProvider(w, req)
+	return false
+}
+
+func (o *oidcAuthenticator) redirectToProvider(w http.ResponseWriter, req *http.Request) {
+	state := o.sign(originalURL(req))
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Domain:   o.cookieDomain,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		MaxAge:   int(5 * time.Minute / time.Second),
+	})
+	http.Redirect(w, req, o.oauth2.AuthCodeURL(state), http.StatusFound)
+}
+
+func (o *oidcAuthenticator) handleCallback(w http.ResponseWriter, req *http.Request) {
+	stateCookie, err := req.Cookie(oidcStateCookie)
+	if err != nil || stateCookie.Value != req.URL.Query().Get("state") {
+		http.Error(w, "invalid oidc state", http.StatusBadRequest)
+		return
+	}
+	redirectTo, ok := o.verify(stateCookie.Value)
+	if !ok {
+		http.Error(w, "invalid oidc state", http.StatusBadRequest)
+		return
+	}
+
+	token, err := o.oauth2.Exchange(req.Context(), req.URL.Query().Get("code"))
+	if err != nil {
+		slog.Error("oidc code exchange failed", "error", err)
+		http.Error(w, "oidc exchange failed", http.StatusBadGateway)
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		http.Error(w, "oidc provider did not return an id_token", http.StatusBadGateway)
+		return
+	}
+	idToken, err := o.verifier.Verify(req.Context(), rawIDToken)
+	if err != nil {
+		slog.Error("oidc id_token verification failed", "error", err)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var claims struct {
+		Email  string   `json:"email"`
+		Groups []string `json:"groups"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		slog.Error("cannot decode oidc claims", "error", err)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !o.cfg.isAllowed(claims.Email, claims.Groups) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	o.setSession(w, req, claims.Email, claims.Groups)
+	http.Redirect(w, req, redirectTo, http.StatusFound)
+}
+
+func (o *oidcAuthenticator) setSession(w http.ResponseWriter, req *http.Request, email string, groups []string) {
+	sess := oidcSession{Email: email, Groups: groups, Expires: time.Now().Add(oidcSessionTTL)}
+	b, err := json.Marshal(sess)
+	if err != nil {
+		slog.Error("cannot marshal oidc session", "error", err)
+		return
+	}
+	value := o.sign(string(b))
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcSessionCookie,
+		Value:    value,
+		Domain:   o.cookieDomain,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		Expires:  sess.Expires,
+	})
+}
+
+func (o *oidcAuthenticator) validSession(req *http.Request) (oidcSession, bool) {
+	c, err := req.Cookie(oidcSessionCookie)
+	if err != nil {
+		return oidcSession{}, false
+	}
+	payload, ok := o.verify(c.Value)
+	if !ok {
+		return oidcSession{}, false
+	}
+	var sess oidcSession
+	if err := json.Unmarshal([]byte(payload), &sess); err != nil {
+		return oidcSession{}, false
+	}
+	if time.Now().After(sess.Expires) {
+		return oidcSession{}, false
+	}
+	return sess, true
+}
+
+// sign returns payload with an HMAC-SHA256 signature appended, so a
+// tampered cookie value fails verify.
+func (o *oidcAuthenticator) sign(payload string) string {
+	mac := hmac.New(sha256.New, []byte(o.cfg.CookieSecret))
+	mac.Write([]byte(payload))
+	sig := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + sig
+}
+
+func (o *oidcAuthenticator) verify(signed string) (string, bool) {
+	parts := strings.SplitN(signed, ".", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+	mac := hmac.New(sha256.New, []byte(o.cfg.CookieSecret))
+	mac.Write(payload)
+	expected := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(parts[1])) {
+		return "", false
+	}
+	return string(payload), true
+}
+
+func originalURL(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, req.Host, req.URL.RequestURI())
+}
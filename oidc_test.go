@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestOIDCSignVerifyRoundTrip(t *testing.T) {
+	o := &oidcAuthenticator{cfg: OIDCAuth{CookieSecret: "shh"}}
+
+	signed := o.sign("hello world")
+	payload, ok := o.verify(signed)
+	if !ok {
+		t.Fatal("expected signed payload to verify")
+	}
+	if payload != "hello world" {
+		t.Errorf("payload = %q, want %q", payload, "hello world")
+	}
+}
+
+func TestOIDCVerifyRejectsTampering(t *testing.T) {
+	o := &oidcAuthenticator{cfg: OIDCAuth{CookieSecret: "shh"}}
+	signed := o.sign("hello world")
+
+	// Flip the last byte of the signature to simulate tampering.
+	tampered := signed[:len(signed)-1] + "x"
+	if _, ok := o.verify(tampered); ok {
+		t.Error("expected tampered payload to fail verification")
+	}
+}
+
+func TestOIDCVerifyRejectsWrongSecret(t *testing.T) {
+	signed := (&oidcAuthenticator{cfg: OIDCAuth{CookieSecret: "shh"}}).sign("hello world")
+	other := &oidcAuthenticator{cfg: OIDCAuth{CookieSecret: "different"}}
+	if _, ok := other.verify(signed); ok {
+		t.Error("expected payload signed with a different secret to fail verification")
+	}
+}
+
+func TestOIDCIsAllowed(t *testing.T) {
+	cfg := OIDCAuth{AllowedEmails: []string{"alice@example.com"}, AllowedGroups: []string{"admins"}}
+
+	if !cfg.isAllowed("Alice@example.com", nil) {
+		t.Error("expected allowed email (case-insensitive) to pass")
+	}
+	if !cfg.isAllowed("bob@example.com", []string{"admins"}) {
+		t.Error("expected member of an allowed group to pass")
+	}
+	if cfg.isAllowed("eve@example.com", []string{"guests"}) {
+		t.Error("expected neither allowed email nor group to fail")
+	}
+
+	open := OIDCAuth{}
+	if !open.isAllowed("anyone@example.com", nil) {
+		t.Error("expected no allow-list configured to allow everyone")
+	}
+}
@@ -0,0 +1,119 @@
+// Package events provides an in-memory publish/subscribe bus that lets
+// external tooling (dashboards, CI scripts, peer mirage-ecs instances)
+// observe reverse-proxy routing changes without polling.
+package events
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Action identifies what kind of change a ProxyEvent describes.
+type Action string
+
+const (
+	ActionAdd    Action = "add"
+	ActionRemove Action = "remove"
+)
+
+// ProxyEvent is one routing change, addressable by a monotonically
+// increasing Cursor so subscribers can resume a stream after a
+// disconnect instead of missing events or replaying everything.
+type ProxyEvent struct {
+	Cursor    uint64    `json:"cursor"`
+	Action    Action    `json:"action"`
+	Subdomain string    `json:"subdomain"`
+	IPAddress string    `json:"ip,omitempty"`
+	Port      int       `json:"port,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// defaultBacklog bounds how many past events a newly (re)connected
+// subscriber can replay via Subscribe's since cursor.
+const defaultBacklog = 1024
+
+// Bus is an in-memory event log with replay-from-cursor support.
+type Bus struct {
+	mu      sync.Mutex
+	cursor  uint64
+	backlog int
+	events  []ProxyEvent
+	subs    map[chan ProxyEvent]struct{}
+}
+
+func NewBus() *Bus {
+	return &Bus{
+		backlog: defaultBacklog,
+		subs:    make(map[chan ProxyEvent]struct{}),
+	}
+}
+
+// Publish stamps ev with the next cursor, appends it to the backlog, and
+// fans it out to every live subscriber. A subscriber whose channel is full
+// misses the event rather than blocking the publisher; it stays subscribed.
+func (b *Bus) Publish(ev ProxyEvent) ProxyEvent {
+	b.mu.Lock()
+	b.cursor++
+	ev.Cursor = b.cursor
+	b.events = append(b.events, ev)
+	if len(b.events) > b.backlog {
+		b.events = b.events[len(b.events)-b.backlog:]
+	}
+	subs := make([]chan ProxyEvent, 0, len(b.subs))
+	for ch := range b.subs {
+		subs = append(subs, ch)
+	}
+	b.mu.Unlock()
+
+	for _, ch := range subs {
+		select {
+		case ch <- ev:
+		default:
+			// slow subscriber; drop rather than block Publish
+		}
+	}
+	return ev
+}
+
+// subscriberBacklog is the channel capacity reserved for live events once
+// a subscriber is caught up, on top of whatever room replay itself needs.
+const subscriberBacklog = 64
+
+// Subscribe registers a new subscriber, replays any backlogged events
+// with a cursor greater than since (0 replays everything retained), and
+// then delivers live events until ctx is done. The channel is sized to
+// hold the full replay plus subscriberBacklog live events, and replay
+// sends are unconditional (not best-effort), so a subscriber resuming
+// after a long gap gets every retained event instead of silently losing
+// whatever didn't fit in a fixed-size buffer.
+func (b *Bus) Subscribe(ctx context.Context, since uint64) (<-chan ProxyEvent, func()) {
+	b.mu.Lock()
+	var toReplay []ProxyEvent
+	for _, ev := range b.events {
+		if ev.Cursor > since {
+			toReplay = append(toReplay, ev)
+		}
+	}
+	ch := make(chan ProxyEvent, len(toReplay)+subscriberBacklog)
+	for _, ev := range toReplay {
+		ch <- ev
+	}
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+	go func() {
+		<-ctx.Done()
+		unsubscribe()
+	}()
+	return ch, unsubscribe
+}
@@ -0,0 +1,74 @@
+package events
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSubscribeReplaysBeyondSubscriberBacklog(t *testing.T) {
+	b := NewBus()
+	const n = 200 // well beyond subscriberBacklog
+	for i := 0; i < n; i++ {
+		b.Publish(ProxyEvent{Action: ActionAdd, Subdomain: "app"})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, unsubscribe := b.Subscribe(ctx, 0)
+	defer unsubscribe()
+
+	got := 0
+	for i := 0; i < n; i++ {
+		select {
+		case <-ch:
+			got++
+		default:
+			t.Fatalf("only received %d of %d backlogged events", got, n)
+		}
+	}
+	if got != n {
+		t.Errorf("replayed %d events, want %d", got, n)
+	}
+}
+
+func TestSubscribeReplaysOnlyEventsAfterCursor(t *testing.T) {
+	b := NewBus()
+	var last ProxyEvent
+	for i := 0; i < 5; i++ {
+		last = b.Publish(ProxyEvent{Action: ActionAdd, Subdomain: "app"})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, unsubscribe := b.Subscribe(ctx, last.Cursor)
+	defer unsubscribe()
+
+	select {
+	case ev := <-ch:
+		t.Fatalf("expected no replay past the latest cursor, got %+v", ev)
+	default:
+	}
+}
+
+func TestPublishTrimsBacklog(t *testing.T) {
+	b := NewBus()
+	b.backlog = 3
+	for i := 0; i < 10; i++ {
+		b.Publish(ProxyEvent{Action: ActionAdd, Subdomain: "app"})
+	}
+	if len(b.events) != 3 {
+		t.Errorf("len(events) = %d, want 3", len(b.events))
+	}
+}
+
+func TestUnsubscribeClosesChannel(t *testing.T) {
+	b := NewBus()
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, unsubscribe := b.Subscribe(ctx, 0)
+	unsubscribe()
+	cancel()
+
+	if _, ok := <-ch; ok {
+		t.Error("expected channel to be closed after unsubscribe")
+	}
+}
@@ -1,17 +1,26 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
 	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	//	"github.com/acidlemon/go-dumper"
+	"github.com/mashiike/mirage-ecs/pkg/events"
 	"github.com/methane/rproxy"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/net/http2"
 )
 
 type proxyAction string
@@ -23,35 +32,82 @@ const (
 )
 
 type proxyControl struct {
-	Action    proxyAction
-	Subdomain string
-	IPAddress string
-	Port      int
+	Action      proxyAction
+	Subdomain   string
+	IPAddress   string
+	Port        int
+	LoadBalance string
+	// Weight is this backend's relative share of traffic under the
+	// "weighted" load-balancing policy. It is per add (i.e. per ECS task),
+	// not per listen port, since a subdomain's replicas can each warrant a
+	// different share. A non-positive value counts as weight 1.
+	Weight int
+	Auth   *Auth
 }
 
 type ReverseProxy struct {
 	mu        sync.RWMutex
 	cfg       *Config
-	domainMap map[string]proxyHandlers
+	domainMap map[string]*subdomainRoutes
+	events    *events.Bus
 }
 
 func NewReverseProxy(cfg *Config) *ReverseProxy {
 	return &ReverseProxy{
 		cfg:       cfg,
-		domainMap: make(map[string]proxyHandlers),
+		domainMap: make(map[string]*subdomainRoutes),
+		events:    events.NewBus(),
 	}
 }
 
+// Events returns the bus that AddSubdomain/RemoveSubdomain publish onto,
+// for wiring up the /events SSE endpoint.
+func (r *ReverseProxy) Events() *events.Bus {
+	return r.events
+}
+
 func (r *ReverseProxy) ServeHTTPWithPort(w http.ResponseWriter, req *http.Request, port int) {
+	start := time.Now()
 	subdomain := strings.ToLower(strings.Split(req.Host, ".")[0])
+	req, span := startProxySpan(req, subdomain)
 
-	if handler := r.findHandler(subdomain, port); handler != nil {
-		log.Printf("[debug] proxy handler found for subdomain %s", subdomain)
-		handler.ServeHTTP(w, req)
-	} else {
-		log.Printf("[warn] proxy handler not found for subdomain %s", subdomain)
-		http.NotFound(w, req)
+	rec := &statusRecordingWriter{ResponseWriter: w, status: http.StatusOK}
+	var upstream string
+	defer func() {
+		span.SetAttributes(attribute.Int("http.status_code", rec.status))
+		span.End()
+		slog.Info("access request",
+			"subdomain", subdomain,
+			"method", req.Method,
+			"path", req.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"upstream", upstream,
+		)
+	}()
+
+	routes := r.routesFor(subdomain)
+	if routes == nil {
+		slog.Warn("proxy handler not found", "subdomain", subdomain)
+		http.NotFound(rec, req)
+		return
 	}
+
+	if routes.authenticator != nil && !routes.authenticator.Authenticate(rec, req, isUpgradeRequest(req)) {
+		return
+	}
+
+	slog.Debug("findHandler", "subdomain", subdomain, "port", port)
+	handler, ip, ok := r.selectHandler(routes, port)
+	if !ok {
+		slog.Warn("proxy handler not found", "subdomain", subdomain, "port", port)
+		http.NotFound(rec, req)
+		return
+	}
+	upstream = ip
+	slog.Debug("proxy handler found", "subdomain", subdomain)
+	handler.ServeHTTP(rec, req)
 }
 
 func (r *ReverseProxy) Exists(subdomain string) bool {
@@ -79,142 +135,423 @@ func (r *ReverseProxy) Subdomains() []string {
 	return ds
 }
 
-func (r *ReverseProxy) findHandler(subdomain string, port int) http.Handler {
+// routesFor resolves the subdomainRoutes for subdomain, falling back to a
+// path.Match wildcard lookup the same way Exists does.
+func (r *ReverseProxy) routesFor(subdomain string) *subdomainRoutes {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	log.Printf("[debug] findHandler for %s:%d", subdomain, port)
-
-	proxyHandlers, ok := r.domainMap[subdomain]
-	if !ok {
-		for name, ph := range r.domainMap {
-			if m, _ := path.Match(name, subdomain); m {
-				proxyHandlers = ph
-				break
-			}
-		}
-		if proxyHandlers == nil {
-			return nil
+	if routes, ok := r.domainMap[subdomain]; ok {
+		return routes
+	}
+	for name, sr := range r.domainMap {
+		if m, _ := path.Match(name, subdomain); m {
+			return sr
 		}
 	}
+	return nil
+}
 
-	handler, ok := proxyHandlers.Handler(port)
-	if !ok {
-		return nil
-	}
-	return handler
+// selectHandler picks a backend for routes/port. routes.Handler locks
+// routes.mu itself, so picking a backend for one subdomain no longer
+// contends with every other subdomain's requests for a single proxy-wide
+// lock; it also returns the backend's IP address, for access logging.
+func (r *ReverseProxy) selectHandler(routes *subdomainRoutes, port int) (http.Handler, string, bool) {
+	return routes.Handler(port)
 }
 
+// proxyHandler is a single backend target behind one (subdomain, port)
+// route. Besides the idle-timeout timer it tracks the state needed by the
+// load balancer and outlier detector: in-flight request count, consecutive
+// 5xx responses, an active-health-check verdict, and an ejection cooldown.
 type proxyHandler struct {
-	handler http.Handler
-	timer   *time.Timer
+	handler      http.Handler
+	timer        *time.Timer
+	weight       int
+	ip           string
+	activeConns  int64
+	failures     int32
+	healthy      int32 // atomic bool: 1 = passing active health checks, 0 = down
+	ejectedUntil atomic.Value
+	stop         chan struct{} // closed to stop the health-check goroutine, if any
 }
 
-func newProxyHandler(h http.Handler) *proxyHandler {
-	return &proxyHandler{
-		handler: h,
+func newProxyHandler(h http.Handler, weight int, hc *HealthCheck, addr string, ip string) *proxyHandler {
+	ph := &proxyHandler{
 		timer:   time.NewTimer(proxyHandlerLifetime),
+		weight:  weight,
+		ip:      ip,
+		healthy: 1,
+	}
+	ph.handler = &instrumentedHandler{inner: h, owner: ph}
+	if hc != nil {
+		ph.stop = make(chan struct{})
+		go ph.runHealthCheck(addr, *hc)
 	}
+	return ph
 }
 
-func (h *proxyHandler) alive() bool {
+// timedOut reports whether h's idle timer has fired, meaning nothing has
+// called extend() for a full proxyHandlerLifetime. This is independent of
+// health/ejection status: a timed-out handler is gone for good and should be
+// pruned, while one that's merely unhealthy or ejected is expected to
+// recover on its own and should stay registered so its health-check
+// goroutine keeps probing it.
+func (h *proxyHandler) timedOut() bool {
 	select {
 	case <-h.timer.C:
-		return false
-	default:
 		return true
+	default:
+		return false
+	}
+}
+
+// alive reports whether h should currently be offered as a serving
+// candidate: not timed out, passing the active health check, and not in an
+// outlier-ejection cooldown.
+func (h *proxyHandler) alive() bool {
+	if h.timedOut() {
+		return false
+	}
+	if atomic.LoadInt32(&h.healthy) == 0 {
+		return false
+	}
+	if until, ok := h.ejectedUntil.Load().(time.Time); ok && time.Now().Before(until) {
+		return false
 	}
+	return true
 }
 
 func (h *proxyHandler) extend() {
 	h.timer.Reset(proxyHandlerLifetime) // extend lifetime
 }
 
-type proxyHandlers map[int]map[string]*proxyHandler
+// close stops the background health-check goroutine, if one was started.
+func (h *proxyHandler) close() {
+	if h.stop != nil {
+		close(h.stop)
+	}
+}
 
-func (ph proxyHandlers) Handler(port int) (http.Handler, bool) {
-	handlers := ph[port]
-	if len(handlers) == 0 {
-		return nil, false
+// recordResult feeds back the status code of a completed request for
+// outlier detection: enough consecutive 5xx responses ejects the backend
+// for a cooldown period, and any non-5xx response resets the streak.
+func (h *proxyHandler) recordResult(status int) {
+	if status >= http.StatusInternalServerError {
+		failures := atomic.AddInt32(&h.failures, 1)
+		if failures >= outlierConsecutive5xxThreshold {
+			until := time.Now().Add(outlierEjectionCooldown)
+			h.ejectedUntil.Store(until)
+			slog.Warn("ejecting backend after consecutive 5xx responses", "ip", h.ip, "failures", failures, "cooldown_until", until.Format(time.RFC3339))
+		}
+		return
 	}
-	for ipaddress, handler := range ph[port] {
-		if handler.alive() {
-			// return first (randomized by Go's map)
-			return handler.handler, true
-		} else {
-			log.Printf("[info] proxy handler to %s is dead", ipaddress)
-			delete(ph[port], ipaddress)
+	atomic.StoreInt32(&h.failures, 0)
+}
+
+// runHealthCheck polls the backend's health check path on an interval and
+// flips healthy without waiting for the idle timer, mirroring how ECS
+// target group health checks eject unhealthy tasks.
+func (h *proxyHandler) runHealthCheck(addr string, hc HealthCheck) {
+	client := &http.Client{Timeout: hc.Interval / 2}
+	checkUrl := fmt.Sprintf("http://%s%s", addr, hc.Path)
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			resp, err := client.Get(checkUrl)
+			ok := err == nil && resp.StatusCode == hc.ExpectedStatus
+			if resp != nil {
+				resp.Body.Close()
+			}
+			if ok {
+				atomic.StoreInt32(&h.healthy, 1)
+			} else if atomic.SwapInt32(&h.healthy, 0) == 1 {
+				slog.Warn("health check failed", "url", checkUrl, "error", err)
+			}
 		}
 	}
-	return nil, false
 }
 
+// instrumentedHandler wraps a backend's http.Handler so the owning
+// proxyHandler can track in-flight connections (for the least_conn policy)
+// and observe response status codes (for outlier detection).
+type instrumentedHandler struct {
+	inner http.Handler
+	owner *proxyHandler
+}
+
+func (h *instrumentedHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	atomic.AddInt64(&h.owner.activeConns, 1)
+	defer atomic.AddInt64(&h.owner.activeConns, -1)
+	rec := &statusRecordingWriter{ResponseWriter: w, status: http.StatusOK}
+	h.inner.ServeHTTP(rec, req)
+	h.owner.recordResult(rec.status)
+}
+
+type statusRecordingWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusRecordingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecordingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Hijack passes through to the wrapped writer so upgradeAwareHandler can
+// still take over the connection behind this wrapper.
+func (w *statusRecordingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("underlying ResponseWriter does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+type proxyHandlers map[int]map[string]*proxyHandler
+
 func (ph proxyHandlers) exists(port int, ipaddress string) bool {
 	if ph[port] == nil {
 		return false
 	}
-	if h := ph[port][ipaddress]; h == nil {
+	h := ph[port][ipaddress]
+	if h == nil {
 		return false
-	} else if h.alive() {
-		log.Printf("[debug] proxy handler to %s extends lifetime", ipaddress)
-		h.extend()
-		return true
-	} else {
-		log.Printf("[info] proxy handler to %s is dead", ipaddress)
+	}
+	if h.timedOut() {
+		slog.Info("proxy handler timed out, removing", "ip", ipaddress)
+		h.close()
 		delete(ph[port], ipaddress)
 		return false
 	}
+	// Still registered, even if currently unhealthy or ejected: those are
+	// expected to recover on their own, so treat the IP as already present
+	// rather than closing it and letting AddSubdomain register a duplicate.
+	slog.Debug("proxy handler extends lifetime", "ip", ipaddress)
+	h.extend()
+	return true
+}
+
+func (ph proxyHandlers) closeAll() {
+	for _, handlers := range ph {
+		for _, h := range handlers {
+			h.close()
+		}
+	}
 }
 
-func (ph proxyHandlers) add(port int, ipaddress string, h http.Handler) {
+func (ph proxyHandlers) add(port int, ipaddress string, h http.Handler, weight int, hc *HealthCheck, addr string) {
 	if ph[port] == nil {
 		ph[port] = make(map[string]*proxyHandler)
 	}
-	log.Printf("[info] new proxy handler to %s", ipaddress)
-	ph[port][ipaddress] = newProxyHandler(h)
+	slog.Info("new proxy handler", "ip", ipaddress)
+	ph[port][ipaddress] = newProxyHandler(h, weight, hc, addr, ipaddress)
+}
+
+// newTargetHandler builds the http.Handler used to reach a single backend
+// target, choosing the transport based on the PortMap's configured protocol.
+func newTargetHandler(protocol string, destUrl *url.URL) http.Handler {
+	switch protocol {
+	case ProtocolH2C:
+		return newH2CHandler(destUrl)
+	case ProtocolWebSocket:
+		return newUpgradeAwareHandler(destUrl)
+	case ProtocolAuto:
+		// auto detects Connection: Upgrade requests at request time and
+		// falls back to the plain HTTP/1.1 reverse proxy otherwise, so it
+		// is safe to use for both ordinary HTTP and WebSocket targets.
+		return newUpgradeAwareHandler(destUrl)
+	default:
+		return rproxy.NewSingleHostReverseProxy(destUrl)
+	}
+}
+
+// newH2CHandler proxies to a cleartext HTTP/2 (h2c) or gRPC-Web backend by
+// forcing the transport to speak HTTP/2 over a plain TCP connection.
+func newH2CHandler(destUrl *url.URL) http.Handler {
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = destUrl.Scheme
+			req.URL.Host = destUrl.Host
+		},
+		Transport: transport,
+	}
+}
+
+// upgradeAwareHandler wraps the default rproxy handler and hijacks
+// Connection: Upgrade requests (WebSocket, SPDY-style protocol switches such
+// as kubectl exec/port-forward) so the raw TCP stream is copied directly
+// between client and target instead of being parsed as HTTP/1.1.
+type upgradeAwareHandler struct {
+	destAddr string
+	fallback http.Handler
+}
+
+func newUpgradeAwareHandler(destUrl *url.URL) http.Handler {
+	return &upgradeAwareHandler{
+		destAddr: destUrl.Host,
+		fallback: rproxy.NewSingleHostReverseProxy(destUrl),
+	}
 }
 
-func (r *ReverseProxy) AddSubdomain(subdomain string, ipaddress string, targetPort int) {
+func (h *upgradeAwareHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !isUpgradeRequest(req) {
+		h.fallback.ServeHTTP(w, req)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		slog.Error("cannot hijack connection for upgrade request", "target", h.destAddr)
+		http.Error(w, "upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+
+	target, err := net.Dial("tcp", h.destAddr)
+	if err != nil {
+		slog.Error("cannot dial upgrade target", "target", h.destAddr, "error", err)
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+
+	client, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		slog.Error("cannot hijack client connection", "error", err)
+		http.Error(w, "upgrade failed", http.StatusInternalServerError)
+		return
+	}
+	defer client.Close()
+
+	if err := req.Write(target); err != nil {
+		slog.Error("cannot forward upgrade request", "target", h.destAddr, "error", err)
+		return
+	}
+	if clientBuf.Reader.Buffered() > 0 {
+		if _, err := io.CopyN(target, clientBuf.Reader, int64(clientBuf.Reader.Buffered())); err != nil {
+			slog.Error("cannot flush buffered client data", "target", h.destAddr, "error", err)
+			return
+		}
+	}
+
+	slog.Info("upgraded connection", "target", h.destAddr)
+
+	done := make(chan struct{}, 2)
+	go copyAndClose(done, target, client)
+	go copyAndClose(done, client, target)
+	<-done
+	<-done
+}
+
+func copyAndClose(done chan<- struct{}, dst io.Writer, src io.Reader) {
+	io.Copy(dst, src)
+	if c, ok := dst.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	}
+	done <- struct{}{}
+}
+
+func isUpgradeRequest(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get("Connection"), "upgrade") ||
+		strings.Contains(strings.ToLower(req.Header.Get("Connection")), "upgrade")
+}
+
+func (r *ReverseProxy) AddSubdomain(subdomain string, ipaddress string, targetPort int, loadBalance string, weight int, auth *Auth) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	var ph proxyHandlers
-	if _ph, exists := r.domainMap[subdomain]; exists {
-		ph = _ph
+	sr, exists := r.domainMap[subdomain]
+	if !exists {
+		sr = newSubdomainRoutes(parseLoadBalancePolicy(loadBalance))
+		if auth != nil {
+			sr.authenticator = newAuthenticator(*auth, r.cfg.Host.ReverseProxySuffix)
+		} else {
+			sr.authenticator = newAuthenticator(r.cfg.Auth, r.cfg.Host.ReverseProxySuffix)
+		}
 	} else {
-		ph = make(proxyHandlers)
+		if loadBalance != "" {
+			sr.loadBalance = parseLoadBalancePolicy(loadBalance)
+		}
+		if auth != nil {
+			sr.authenticator = newAuthenticator(*auth, r.cfg.Host.ReverseProxySuffix)
+		}
 	}
 
-	// create reverse proxy
+	// create reverse proxy. sr.handlers is also read and pruned by
+	// sr.Handler on every request, which locks sr.mu rather than r.mu, so
+	// mutating it here needs the same lock.
+	sr.mu.Lock()
 	for _, v := range r.cfg.Listen.HTTP {
 		if v.TargetPort != targetPort {
 			continue
 		}
-		if ph.exists(v.ListenPort, ipaddress) {
+		if sr.handlers.exists(v.ListenPort, ipaddress) {
 			continue
 		}
 		destUrlString := fmt.Sprintf("http://%s:%d", ipaddress, v.TargetPort)
 		destUrl, _ := url.Parse(destUrlString)
-		handler := rproxy.NewSingleHostReverseProxy(destUrl)
-		ph.add(v.ListenPort, ipaddress, handler)
-		log.Printf("[info] add subdomain: %s:%d -> %s:%d", subdomain, v.ListenPort, ipaddress, targetPort)
+		handler := newTargetHandler(v.protocol(), destUrl)
+		addr := fmt.Sprintf("%s:%d", ipaddress, v.TargetPort)
+		sr.handlers.add(v.ListenPort, ipaddress, handler, weight, v.healthCheck(), addr)
+		slog.Info("add subdomain",
+			"subdomain", subdomain,
+			"listen_port", v.ListenPort,
+			"ip", ipaddress,
+			"target_port", targetPort,
+			"load_balance", sr.loadBalance,
+		)
+		r.events.Publish(events.ProxyEvent{
+			Action:    events.ActionAdd,
+			Subdomain: subdomain,
+			IPAddress: ipaddress,
+			Port:      v.ListenPort,
+			Timestamp: time.Now(),
+		})
 	}
-	r.domainMap[subdomain] = ph
+	sr.mu.Unlock()
+	r.domainMap[subdomain] = sr
 }
 
 func (r *ReverseProxy) RemoveSubdomain(subdomain string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	log.Println("[info] removing subdomain:", subdomain)
+	slog.Info("removing subdomain", "subdomain", subdomain)
+	if sr, exists := r.domainMap[subdomain]; exists {
+		sr.mu.Lock()
+		sr.handlers.closeAll()
+		sr.mu.Unlock()
+	}
 	delete(r.domainMap, subdomain)
+	r.events.Publish(events.ProxyEvent{
+		Action:    events.ActionRemove,
+		Subdomain: subdomain,
+		Timestamp: time.Now(),
+	})
 }
 
 func (r *ReverseProxy) Modify(action *proxyControl) {
 	switch action.Action {
 	case proxyAdd:
-		r.AddSubdomain(action.Subdomain, action.IPAddress, action.Port)
+		r.AddSubdomain(action.Subdomain, action.IPAddress, action.Port, action.LoadBalance, action.Weight, action.Auth)
 	case proxyRemove:
 		r.RemoveSubdomain(action.Subdomain)
 	default:
-		log.Printf("[error] unknown proxy action: %s", action.Action)
+		slog.Error("unknown proxy action", "action", action.Action)
 	}
 }
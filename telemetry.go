@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Telemetry configures OpenTelemetry trace export for the reverse proxy.
+// Leaving OTLPEndpoint unset disables tracing entirely: SetupTelemetry
+// installs a no-op tracer provider so startProxySpan stays cheap to call
+// unconditionally.
+type Telemetry struct {
+	ServiceName  string  `yaml:"service_name"`
+	OTLPEndpoint string  `yaml:"otlp_endpoint"`
+	Insecure     bool    `yaml:"insecure"`
+	SampleRatio  float64 `yaml:"sample_ratio"`
+}
+
+const defaultServiceName = "mirage-ecs"
+
+// tracer is used by startProxySpan; SetupTelemetry replaces it once the
+// real TracerProvider (or the no-op fallback) is registered globally.
+var tracer = otel.Tracer(defaultServiceName)
+
+// SetupTelemetry wires up the global TracerProvider and propagator from
+// cfg.Telemetry, returning a shutdown func to flush on exit. When
+// Telemetry.OTLPEndpoint is empty, it installs otel's built-in no-op
+// provider so the rest of the codebase doesn't need to branch on whether
+// tracing is enabled.
+func SetupTelemetry(ctx context.Context, cfg *Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	if cfg.Telemetry.OTLPEndpoint == "" {
+		tracer = trace.NewNoopTracerProvider().Tracer(defaultServiceName)
+		return func(context.Context) error { return nil }, nil
+	}
+
+	serviceName := cfg.Telemetry.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Telemetry.OTLPEndpoint)}
+	if cfg.Telemetry.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create otlp exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName(serviceName),
+		attribute.String("service.version", version),
+		attribute.String("service.build_date", buildDate),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("cannot build resource: %w", err)
+	}
+
+	ratio := cfg.Telemetry.SampleRatio
+	if ratio <= 0 {
+		ratio = 1
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(tp)
+	tracer = tp.Tracer(serviceName)
+	return tp.Shutdown, nil
+}
+
+// startProxySpan starts a span for one proxied request and injects the
+// resulting trace context into req's headers so the backend can continue
+// the same trace, returning the request (now carrying the span's context)
+// and the span for the caller to annotate and end.
+func startProxySpan(req *http.Request, subdomain string) (*http.Request, trace.Span) {
+	ctx, span := tracer.Start(req.Context(), "proxy.request",
+		trace.WithAttributes(
+			attribute.String("mirage.subdomain", subdomain),
+			semconv.HTTPMethod(req.Method),
+			semconv.HTTPTarget(req.URL.Path),
+		),
+	)
+	req = req.WithContext(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return req, span
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// NewTLSConfig builds the *tls.Config HTTPS listeners serve with, choosing
+// the certificate source from cfg.Listen.TLS.CertSource.
+func NewTLSConfig(cfg *Config) (*tls.Config, error) {
+	switch cfg.Listen.TLS.CertSource {
+	case TLSCertSourceACME:
+		mgr, err := newACMEManager(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return mgr.TLSConfig(), nil
+	default:
+		cert, err := loadStaticCertificate(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	}
+}
+
+func loadStaticCertificate(cfg *Config) (tls.Certificate, error) {
+	t := cfg.Listen.TLS
+	if t.CertSecretARN != "" {
+		return loadCertificateFromSecret(cfg, t.CertSecretARN)
+	}
+	if t.CertFile == "" || t.KeyFile == "" {
+		return tls.Certificate{}, fmt.Errorf("listen.tls.cert_file and key_file (or cert_secret_arn) are required for cert_source=%q", TLSCertSourceStatic)
+	}
+	return tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+}
+
+// loadCertificateFromSecret fetches a "cert PEM + separator + key PEM"
+// bundle from AWS Secrets Manager or SSM Parameter Store, dispatching on
+// the service segment of arn the same way the AWS SDK itself would.
+func loadCertificateFromSecret(cfg *Config, arn string) (tls.Certificate, error) {
+	var bundle string
+	switch {
+	case strings.Contains(arn, ":secretsmanager:"):
+		svc := secretsmanager.New(cfg.session)
+		out, err := svc.GetSecretValue(&secretsmanager.GetSecretValueInput{SecretId: aws.String(arn)})
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("get secret %s: %w", arn, err)
+		}
+		if out.SecretString != nil {
+			bundle = *out.SecretString
+		} else {
+			bundle = string(out.SecretBinary)
+		}
+	case strings.Contains(arn, ":ssm:"):
+		svc := ssm.New(cfg.session)
+		out, err := svc.GetParameter(&ssm.GetParameterInput{Name: aws.String(arn), WithDecryption: aws.Bool(true)})
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("get ssm parameter %s: %w", arn, err)
+		}
+		bundle = aws.StringValue(out.Parameter.Value)
+	default:
+		return tls.Certificate{}, fmt.Errorf("unrecognized cert_secret_arn %s: expected a secretsmanager or ssm ARN", arn)
+	}
+
+	certPEM, keyPEM, err := splitCertBundle(bundle)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// certBundleSeparator splits the cert and key PEM blocks within a single
+// secret value, since Secrets Manager and SSM both store one string.
+const certBundleSeparator = "\n---\n"
+
+func splitCertBundle(bundle string) (cert, key []byte, err error) {
+	parts := strings.SplitN(bundle, certBundleSeparator, 2)
+	if len(parts) != 2 {
+		return nil, nil, fmt.Errorf("cert bundle must be a certificate PEM block, %q, then the key PEM block", certBundleSeparator)
+	}
+	return []byte(parts[0]), []byte(parts[1]), nil
+}
+
+// RedirectHTTPSHandler redirects every request to the same host and path
+// over HTTPS. Wire it up in place of the usual handler on an HTTP
+// listener when Listen.TLS.RedirectHTTP is set.
+func RedirectHTTPSHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		target := "https://" + req.Host + req.URL.RequestURI()
+		http.Redirect(w, req, target, http.StatusMovedPermanently)
+	})
+}
+
+// withHSTS wraps next to add a Strict-Transport-Security header to every
+// response. Wire it around an HTTPS listener's handler when
+// Listen.TLS.HSTS is set.
+func withHSTS(next http.Handler, maxAgeSeconds int) http.Handler {
+	if maxAgeSeconds <= 0 {
+		maxAgeSeconds = 365 * 24 * 60 * 60 // 1 year
+	}
+	header := "max-age=" + strconv.Itoa(maxAgeSeconds) + "; includeSubDomains"
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Strict-Transport-Security", header)
+		next.ServeHTTP(w, req)
+	})
+}